@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned when a connection is rejected because the
+// circuit breaker for its resolved target is currently open.
+var ErrBreakerOpen = errors.New("circuit breaker open for upstream target")
+
+// CircuitBreakerConfig configures per-target circuit breaking for an
+// upstream. It is attached to UpstreamConfig as the CircuitBreaker field.
+type CircuitBreakerConfig struct {
+	// MaxConcurrent limits the number of connections dialed to a single
+	// resolved target at once. Zero means unlimited.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// MaxPending additionally allows this many dials beyond MaxConcurrent
+	// before new connections are rejected outright. There is no real queue:
+	// rejection is immediate, it never blocks waiting for a slot to free up.
+	MaxPending int `json:"max_pending,omitempty"`
+
+	// ConsecutiveFailures is the number of consecutive dial failures to a
+	// target required to open the breaker for it. Defaults to 5.
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+
+	// CooldownMs is how long the breaker stays open for a target before
+	// letting a single trial connection through again. Defaults to 10000.
+	CooldownMs int `json:"cooldown_ms,omitempty"`
+}
+
+func (c *CircuitBreakerConfig) applyDefaults() {
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = 5
+	}
+	if c.CooldownMs == 0 {
+		c.CooldownMs = 10000
+	}
+}
+
+// RetryPolicy bounds retries of a failed upstream dial with exponential
+// backoff and full jitter. It is attached to UpstreamConfig as the
+// RetryPolicy field.
+type RetryPolicy struct {
+	// MaxRetries is the number of additional dial attempts after the first
+	// failure. Zero disables retries.
+	MaxRetries int `json:"max_retries,omitempty"`
+
+	// BaseDelayMs is the starting backoff delay. Defaults to 50.
+	BaseDelayMs int `json:"base_delay_ms,omitempty"`
+
+	// MaxDelayMs caps the backoff delay. Defaults to 2000.
+	MaxDelayMs int `json:"max_delay_ms,omitempty"`
+}
+
+func (r *RetryPolicy) applyDefaults() {
+	if r.BaseDelayMs == 0 {
+		r.BaseDelayMs = 50
+	}
+	if r.MaxDelayMs == 0 {
+		r.MaxDelayMs = 2000
+	}
+}
+
+// Backoff returns the delay to wait before retry attempt n (0-indexed),
+// exponential in n with full jitter, capped at MaxDelayMs.
+func (r RetryPolicy) Backoff(n int) time.Duration {
+	max := time.Duration(r.MaxDelayMs) * time.Millisecond
+	d := time.Duration(r.BaseDelayMs) * time.Millisecond << uint(n)
+	if d <= 0 || d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// breakerState is the circuit breaker's bookkeeping for one resolved
+// upstream target (a single service instance), not the upstream as a whole.
+type breakerState struct {
+	inFlight            int
+	consecutiveFailures int
+
+	// open, openUntil and halfOpenTrial together implement the classic
+	// open -> half-open -> closed (or back to open) cycle: once open,
+	// every attempt is rejected until openUntil passes, at which point
+	// exactly one trial connection is admitted (halfOpenTrial) and its
+	// outcome alone decides whether the target closes or re-opens.
+	open          bool
+	openUntil     time.Time
+	halfOpenTrial bool
+}
+
+// circuitBreaker gates and tracks dial attempts per resolved target so that
+// a failing instance of a service trips only its own connections, not its
+// healthy siblings. One circuitBreaker is created per upstream listener.
+type circuitBreaker struct {
+	cfg          CircuitBreakerConfig
+	upstreamName string
+	metrics      MetricsSink
+
+	mu      sync.Mutex
+	targets map[string]*breakerState
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig, upstreamName string, metrics MetricsSink) *circuitBreaker {
+	cfg.applyDefaults()
+	return &circuitBreaker{
+		cfg:          cfg,
+		upstreamName: upstreamName,
+		metrics:      metrics,
+		targets:      make(map[string]*breakerState),
+	}
+}
+
+// Allow reports whether a new connection attempt to target may proceed,
+// returning ErrBreakerOpen if the breaker has tripped for it or an error if
+// the concurrency limit is already exhausted. Callers that get a nil error
+// must call Done once the dial completes.
+func (b *circuitBreaker) Allow(target string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := b.stateForLocked(target)
+
+	if st.open {
+		if time.Now().Before(st.openUntil) {
+			b.rejectLocked(target)
+			return ErrBreakerOpen
+		}
+		if st.halfOpenTrial {
+			// A trial connection is already deciding this target's fate;
+			// don't let a concurrent burst through behind it too.
+			b.rejectLocked(target)
+			return ErrBreakerOpen
+		}
+		// Cooldown elapsed: admit exactly one trial connection. Its
+		// outcome, reported via Done, decides whether the target closes
+		// or re-opens for another cooldown period.
+		st.halfOpenTrial = true
+		st.inFlight++
+		return nil
+	}
+
+	// MaxConcurrent == 0 means this target has no concurrency limit at all;
+	// MaxPending only ever adds slack on top of an actual limit, it never
+	// creates one by itself.
+	limit := 0
+	if b.cfg.MaxConcurrent > 0 {
+		limit = b.cfg.MaxConcurrent + b.cfg.MaxPending
+	}
+	if limit > 0 && st.inFlight >= limit {
+		b.rejectLocked(target)
+		return fmt.Errorf("upstream target %s: too many concurrent connections", target)
+	}
+
+	st.inFlight++
+	return nil
+}
+
+// Done records the outcome of a dial previously allowed by Allow. It no
+// longer releases the inFlight slot Allow reserved: that slot represents a
+// live connection, not just the dial, and is released by Release once the
+// connection actually closes.
+func (b *circuitBreaker) Done(target string, dialErr error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := b.stateForLocked(target)
+
+	wasTrial := st.halfOpenTrial
+	st.halfOpenTrial = false
+
+	if dialErr == nil {
+		if st.open && !wasTrial {
+			// This success belongs to a connection admitted before the
+			// target tripped; it says nothing about whether the target has
+			// recovered, so it must not cancel the open state out from
+			// under the half-open trial that's actually deciding that.
+			return
+		}
+		st.consecutiveFailures = 0
+		if st.open {
+			st.open = false
+			st.openUntil = time.Time{}
+			b.setOpenGaugeLocked(target, false)
+		}
+		return
+	}
+
+	st.consecutiveFailures++
+	if wasTrial || st.consecutiveFailures >= b.cfg.ConsecutiveFailures {
+		st.open = true
+		st.openUntil = time.Now().Add(time.Duration(b.cfg.CooldownMs) * time.Millisecond)
+		b.setOpenGaugeLocked(target, true)
+	}
+}
+
+// Release returns the inFlight slot Allow reserved. After a successful dial
+// it must be called once the connection that dial produced is fully torn
+// down, so MaxConcurrent bounds live connections per target, not just
+// concurrent dials; after a failed dial it is called right after Done.
+func (b *circuitBreaker) Release(target string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stateForLocked(target).inFlight--
+}
+
+// AllOpen reports whether every target this breaker has ever seen a dial
+// for is currently open, i.e. there is no known-healthy target left to try.
+// It returns false until at least one target has been observed, so a fresh
+// upstream with no failure history is never fast-rejected. Callers can use
+// this to reject a connection before resolving a target at all, rather than
+// paying for (and potentially hanging on) a resolver lookup only to have
+// Allow reject it anyway.
+func (b *circuitBreaker) AllOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.targets) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, st := range b.targets {
+		if !st.open || !now.Before(st.openUntil) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *circuitBreaker) rejectLocked(target string) {
+	b.metrics.IncrCounter("upstream.breaker.rejected",
+		map[string]string{"upstream": b.upstreamName, "target": target}, 1)
+}
+
+func (b *circuitBreaker) setOpenGaugeLocked(target string, open bool) {
+	val := 0.0
+	if open {
+		val = 1.0
+	}
+	b.metrics.SetGauge("upstream.breaker.open",
+		map[string]string{"upstream": b.upstreamName, "target": target}, val)
+}
+
+func (b *circuitBreaker) stateForLocked(target string) *breakerState {
+	st, ok := b.targets[target]
+	if !ok {
+		st = &breakerState{}
+		b.targets[target] = st
+	}
+	return st
+}
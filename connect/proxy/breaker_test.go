@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTripsAfterConsecutiveFailures(t *testing.T) {
+	cfg := CircuitBreakerConfig{ConsecutiveFailures: 3, CooldownMs: 10000}
+	b := newCircuitBreaker(cfg, "db", noopSink{})
+
+	for i := 0; i < 2; i++ {
+		if err := b.Allow("10.0.0.1:8080"); err != nil {
+			t.Fatalf("attempt %d: Allow returned %s, want nil", i, err)
+		}
+		b.Done("10.0.0.1:8080", errFailedDial)
+	}
+
+	if err := b.Allow("10.0.0.1:8080"); err != nil {
+		t.Fatalf("Allow before trip returned %s, want nil", err)
+	}
+	b.Done("10.0.0.1:8080", errFailedDial)
+
+	if err := b.Allow("10.0.0.1:8080"); err != ErrBreakerOpen {
+		t.Fatalf("Allow after tripping returned %v, want ErrBreakerOpen", err)
+	}
+}
+
+func TestCircuitBreakerHalfOpenAdmitsOnlyOneTrial(t *testing.T) {
+	cfg := CircuitBreakerConfig{ConsecutiveFailures: 1, CooldownMs: 1}
+	b := newCircuitBreaker(cfg, "db", noopSink{})
+
+	if err := b.Allow("target"); err != nil {
+		t.Fatalf("Allow returned %s, want nil", err)
+	}
+	b.Done("target", errFailedDial)
+
+	time.Sleep(2 * time.Millisecond)
+
+	if err := b.Allow("target"); err != nil {
+		t.Fatalf("first half-open Allow returned %s, want nil", err)
+	}
+	if err := b.Allow("target"); err != ErrBreakerOpen {
+		t.Fatalf("second concurrent half-open Allow returned %v, want ErrBreakerOpen", err)
+	}
+}
+
+func TestCircuitBreakerTrialSuccessClosesBreaker(t *testing.T) {
+	cfg := CircuitBreakerConfig{ConsecutiveFailures: 1, CooldownMs: 1}
+	b := newCircuitBreaker(cfg, "db", noopSink{})
+
+	if err := b.Allow("target"); err != nil {
+		t.Fatalf("Allow returned %s, want nil", err)
+	}
+	b.Done("target", errFailedDial)
+
+	time.Sleep(2 * time.Millisecond)
+
+	if err := b.Allow("target"); err != nil {
+		t.Fatalf("half-open Allow returned %s, want nil", err)
+	}
+	b.Done("target", nil)
+
+	if err := b.Allow("target"); err != nil {
+		t.Fatalf("Allow after trial success returned %s, want nil (breaker should be closed)", err)
+	}
+}
+
+// TestCircuitBreakerStaleSuccessDoesNotCloseOpenBreaker covers the case where
+// a connection admitted while the breaker was still closed finishes
+// successfully after the breaker has since tripped open on other
+// connections: that straggler must not be able to close the breaker out from
+// under the half-open trial that's actually deciding its fate.
+func TestCircuitBreakerStaleSuccessDoesNotCloseOpenBreaker(t *testing.T) {
+	cfg := CircuitBreakerConfig{ConsecutiveFailures: 1, CooldownMs: 10000}
+	b := newCircuitBreaker(cfg, "db", noopSink{})
+
+	if err := b.Allow("target"); err != nil {
+		t.Fatalf("first Allow returned %s, want nil", err)
+	}
+	if err := b.Allow("target"); err != nil {
+		t.Fatalf("second Allow returned %s, want nil", err)
+	}
+
+	// The second connection's dial fails, tripping the breaker.
+	b.Done("target", errFailedDial)
+	if err := b.Allow("target"); err != ErrBreakerOpen {
+		t.Fatalf("Allow after tripping returned %v, want ErrBreakerOpen", err)
+	}
+
+	// The first connection, admitted before the trip, now reports success.
+	b.Done("target", nil)
+
+	if err := b.Allow("target"); err != ErrBreakerOpen {
+		t.Fatalf("Allow after stale success returned %v, want ErrBreakerOpen (breaker should stay open)", err)
+	}
+}
+
+func TestCircuitBreakerReleaseDecrementsInFlightSeparatelyFromDone(t *testing.T) {
+	cfg := CircuitBreakerConfig{MaxConcurrent: 1}
+	b := newCircuitBreaker(cfg, "db", noopSink{})
+
+	if err := b.Allow("target"); err != nil {
+		t.Fatalf("first Allow returned %s, want nil", err)
+	}
+	b.Done("target", nil)
+
+	// Done no longer frees the concurrency slot: the connection the dial
+	// produced is still live, so MaxConcurrent keeps rejecting until Release
+	// is called once that connection actually closes.
+	if err := b.Allow("target"); err == nil {
+		t.Fatal("Allow after Done (but before Release) succeeded, want the slot still held")
+	}
+
+	b.Release("target")
+
+	if err := b.Allow("target"); err != nil {
+		t.Fatalf("Allow after Release returned %s, want nil", err)
+	}
+}
+
+func TestCircuitBreakerAllOpen(t *testing.T) {
+	cfg := CircuitBreakerConfig{ConsecutiveFailures: 1, CooldownMs: 10000}
+	b := newCircuitBreaker(cfg, "db", noopSink{})
+
+	if b.AllOpen() {
+		t.Fatal("AllOpen true with no observed targets, want false")
+	}
+
+	// Register both targets before tripping either, so both are known to
+	// the breaker while only one is actually open.
+	b.Allow("a")
+	b.Allow("b")
+	b.Done("a", errFailedDial)
+	b.Done("b", nil)
+	if b.AllOpen() {
+		t.Fatal("AllOpen true with only one of two known targets tripped, want false")
+	}
+
+	b.Allow("b")
+	b.Done("b", errFailedDial)
+	if !b.AllOpen() {
+		t.Fatal("AllOpen false with every known target open, want true")
+	}
+}
+
+func TestRetryPolicyBackoffIsBoundedAndGrows(t *testing.T) {
+	r := RetryPolicy{BaseDelayMs: 10, MaxDelayMs: 1000}
+
+	for n := 0; n < 10; n++ {
+		d := r.Backoff(n)
+		if d < 0 {
+			t.Fatalf("Backoff(%d) = %s, want >= 0", n, d)
+		}
+		if d > time.Duration(r.MaxDelayMs)*time.Millisecond {
+			t.Fatalf("Backoff(%d) = %s, want <= MaxDelayMs (%dms)", n, d, r.MaxDelayMs)
+		}
+	}
+
+	// The theoretical max for small n should increase until it saturates at
+	// MaxDelayMs, so sampling many draws at a late attempt should reach
+	// noticeably higher values than at attempt 0.
+	const samples = 200
+	var maxAt0, maxAtLate time.Duration
+	for i := 0; i < samples; i++ {
+		if d := r.Backoff(0); d > maxAt0 {
+			maxAt0 = d
+		}
+		if d := r.Backoff(6); d > maxAtLate {
+			maxAtLate = d
+		}
+	}
+	if maxAtLate <= maxAt0 {
+		t.Fatalf("max backoff sampled at attempt 6 (%s) was not greater than at attempt 0 (%s)", maxAtLate, maxAt0)
+	}
+}
+
+func TestRetryPolicyApplyDefaults(t *testing.T) {
+	r := RetryPolicy{}
+	r.applyDefaults()
+	if r.BaseDelayMs != 50 {
+		t.Fatalf("BaseDelayMs default = %d, want 50", r.BaseDelayMs)
+	}
+	if r.MaxDelayMs != 2000 {
+		t.Fatalf("MaxDelayMs default = %d, want 2000", r.MaxDelayMs)
+	}
+}
+
+var errFailedDial = &dialError{"dial failed"}
+
+type dialError struct{ msg string }
+
+func (e *dialError) Error() string { return e.msg }
@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/connect"
+)
+
+// Listener accepts connections on a single local bind address and proxies
+// each one to its counterpart: the local application for the public
+// listener, or a resolved upstream instance for an upstream listener. Every
+// accepted connection is instrumented through the configured MetricsSink.
+type Listener struct {
+	name     string
+	bindAddr string
+	tlsCfg   *tls.Config // set only for the public listener, which terminates mTLS from the mesh
+
+	resolve    func(ctx context.Context) (target string, err error)
+	dialTarget func(ctx context.Context, target string) (net.Conn, error)
+	retry      RetryPolicy
+	breaker    *circuitBreaker // nil for the public listener
+
+	metrics MetricsSink
+	logger  *log.Logger
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	draining bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewPublicListener returns a Listener that terminates inbound mTLS
+// connections from the mesh and forwards each one, as plain TCP, to the
+// local application.
+func NewPublicListener(service *connect.Service, cfg PublicListenerConfig, metrics MetricsSink, logger *log.Logger) *Listener {
+	bindAddr := fmt.Sprintf("%s:%d", cfg.BindAddress, cfg.BindPort)
+	localAddr := fmt.Sprintf("%s:%d", cfg.LocalServiceAddress, cfg.LocalServicePort)
+
+	return &Listener{
+		name:     "public listener",
+		bindAddr: bindAddr,
+		tlsCfg:   service.ServerTLSConfig(),
+		metrics:  metrics,
+		logger:   logger,
+		conns:    make(map[net.Conn]struct{}),
+		resolve: func(ctx context.Context) (string, error) {
+			return localAddr, nil
+		},
+		dialTarget: func(ctx context.Context, target string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", target)
+		},
+	}
+}
+
+// NewUpstreamListener returns a Listener that accepts plain local
+// connections and forwards each one, over mTLS, to an instance of the
+// upstream resolved via uc's configured resolver, gated by breaker and
+// retried per uc.RetryPolicy.
+func NewUpstreamListener(service *connect.Service, uc UpstreamConfig, breaker *circuitBreaker, metrics MetricsSink, logger *log.Logger) *Listener {
+	bindAddr := fmt.Sprintf("%s:%d", uc.LocalBindAddress, uc.LocalBindPort)
+	retry := uc.RetryPolicy
+	retry.applyDefaults()
+
+	return &Listener{
+		name:     uc.String(),
+		bindAddr: bindAddr,
+		breaker:  breaker,
+		retry:    retry,
+		metrics:  metrics,
+		logger:   logger,
+		conns:    make(map[net.Conn]struct{}),
+		resolve: func(ctx context.Context) (string, error) {
+			return uc.resolver.Resolve(ctx)
+		},
+		dialTarget: func(ctx context.Context, target string) (net.Conn, error) {
+			return service.Dial(ctx, target)
+		},
+	}
+}
+
+// BindAddr returns the local address this listener accepts connections on.
+func (l *Listener) BindAddr() string {
+	return l.bindAddr
+}
+
+// Serve accepts connections until the listener is closed or asked to drain,
+// proxying each one to its counterpart in its own goroutine. It returns nil
+// on a clean shutdown (Close or Shutdown) and the accept error otherwise.
+func (l *Listener) Serve() error {
+	ln, err := net.Listen("tcp", l.bindAddr)
+	if err != nil {
+		return err
+	}
+	if l.tlsCfg != nil {
+		ln = tls.NewListener(ln, l.tlsCfg)
+	}
+
+	l.mu.Lock()
+	if l.closed || l.draining {
+		// Close or Shutdown ran before the socket was bound; don't start
+		// accepting behind their back.
+		l.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	l.ln = ln
+	l.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			stopping := l.closed || l.draining
+			l.mu.Unlock()
+			if stopping {
+				return nil
+			}
+			return err
+		}
+
+		l.metrics.IncrCounter("listener.accepted", l.labels(), 1)
+
+		l.mu.Lock()
+		if l.closed || l.draining {
+			// Shutdown/Close already decided no more work should be added
+			// to wg; losing this race to them means losing the connection
+			// too, not sneaking it in behind their wg.Wait.
+			l.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		l.conns[conn] = struct{}{}
+		active := len(l.conns)
+		l.wg.Add(1)
+		l.mu.Unlock()
+		l.metrics.SetGauge("listener.active_connections", l.labels(), float64(active))
+
+		go l.handleConn(conn)
+	}
+}
+
+func (l *Listener) handleConn(conn net.Conn) {
+	start := time.Now()
+	defer l.finishConn(conn, start)
+	defer l.wg.Done()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			l.metrics.IncrCounter("listener.tls_handshake_error", l.labels(), 1)
+			l.logger.Printf("[ERR] %s: TLS handshake failed: %s", l.name, err)
+			return
+		}
+	}
+
+	dst, target, err := l.dial(context.Background())
+	if err != nil {
+		l.logger.Printf("[ERR] %s: failed to connect to target: %s", l.name, err)
+		return
+	}
+	defer dst.Close()
+	if l.breaker != nil {
+		// Release the concurrency slot Allow reserved only once this
+		// connection is actually done, not when the dial that produced it
+		// completed, so MaxConcurrent bounds live connections per target.
+		defer l.breaker.Release(target)
+	}
+
+	l.pipe(conn, dst, target)
+}
+
+// dial resolves the connection's target, gates it through the circuit
+// breaker (if any), and dials it, retrying dial failures with backoff up to
+// retry.MaxRetries times.
+func (l *Listener) dial(ctx context.Context) (net.Conn, string, error) {
+	if l.breaker != nil && l.breaker.AllOpen() {
+		// Every target this breaker knows about is open: reject immediately
+		// rather than paying for (and potentially hanging on) a resolver
+		// lookup whose result Allow would just reject anyway.
+		l.metrics.IncrCounter("listener.upstream_dial_error", l.labels(), 1)
+		return nil, "", ErrBreakerOpen
+	}
+
+	target, err := l.resolve(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve target: %w", err)
+	}
+
+	if l.breaker != nil {
+		if err := l.breaker.Allow(target); err != nil {
+			l.metrics.IncrCounter("listener.upstream_dial_error", l.targetLabels(target), 1)
+			return nil, target, err
+		}
+	}
+
+	var lastErr error
+retryLoop:
+	for attempt := 0; attempt <= l.retry.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(l.retry.Backoff(attempt - 1)):
+			case <-ctx.Done():
+				lastErr = ctx.Err()
+				break retryLoop
+			}
+		}
+
+		conn, err := l.dialTarget(ctx, target)
+		if err == nil {
+			if l.breaker != nil {
+				l.breaker.Done(target, nil)
+			}
+			return conn, target, nil
+		}
+		lastErr = err
+	}
+
+	if l.breaker != nil {
+		l.breaker.Done(target, lastErr)
+		l.breaker.Release(target)
+	}
+	l.metrics.IncrCounter("listener.upstream_dial_error", l.targetLabels(target), 1)
+	return nil, target, lastErr
+}
+
+// pipe copies bytes in both directions between the accepted connection and
+// its dialed counterpart until both sides are done, reporting bytes
+// transferred and half-closing each side as the other finishes so neither
+// copy blocks forever once its peer has gone away.
+func (l *Listener) pipe(a, b net.Conn, target string) {
+	labels := l.targetLabels(target)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(b, a)
+		l.metrics.IncrCounter("listener.bytes_in", labels, uint64(n))
+		closeWrite(b)
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(a, b)
+		l.metrics.IncrCounter("listener.bytes_out", labels, uint64(n))
+		closeWrite(a)
+	}()
+	wg.Wait()
+}
+
+// closeWrite half-closes conn's write side if the underlying connection
+// supports it (TCP and TLS both do).
+func closeWrite(conn net.Conn) {
+	type writeCloser interface {
+		CloseWrite() error
+	}
+	if wc, ok := conn.(writeCloser); ok {
+		_ = wc.CloseWrite()
+	}
+}
+
+func (l *Listener) finishConn(conn net.Conn, start time.Time) {
+	conn.Close()
+
+	l.mu.Lock()
+	delete(l.conns, conn)
+	active := len(l.conns)
+	l.mu.Unlock()
+
+	l.metrics.SetGauge("listener.active_connections", l.labels(), float64(active))
+	l.metrics.AddSample("listener.connection_duration_ms", l.labels(), float64(time.Since(start).Milliseconds()))
+}
+
+func (l *Listener) labels() map[string]string {
+	return map[string]string{"listener": l.name}
+}
+
+func (l *Listener) targetLabels(target string) map[string]string {
+	return map[string]string{"listener": l.name, "target": target}
+}
+
+// Close immediately stops accepting connections and closes every connection
+// currently being proxied. It is safe to call more than once.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	ln := l.ln
+	conns := make([]net.Conn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	return err
+}
+
+// Shutdown stops accepting new connections but leaves connections already
+// being proxied to finish on their own, returning once they all have or ctx
+// is done (in which case any still in flight are force-closed).
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.draining = true
+	ln := l.ln
+	l.mu.Unlock()
+
+	if ln != nil {
+		if err := ln.Close(); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return l.Close()
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestListener() *Listener {
+	return &Listener{
+		name:    "test",
+		conns:   make(map[net.Conn]struct{}),
+		metrics: noopSink{},
+		logger:  log.New(io.Discard, "", 0),
+	}
+}
+
+func waitForListenerAddr(t *testing.T, l *Listener) string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		ln := l.ln
+		l.mu.Unlock()
+		if ln != nil {
+			return ln.Addr().String()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("listener never started accepting")
+	return ""
+}
+
+// TestListenerShutdownDrainsInFlightConnections verifies that Shutdown waits
+// for a connection already being proxied to finish on its own rather than
+// cutting it off the moment draining starts, and that the listening socket
+// stops taking new connections as soon as draining starts.
+func TestListenerShutdownDrainsInFlightConnections(t *testing.T) {
+	pipeServer, pipeClient := net.Pipe()
+	accepted := make(chan struct{})
+
+	l := newTestListener()
+	l.bindAddr = "127.0.0.1:0"
+	l.resolve = func(ctx context.Context) (string, error) { return "target", nil }
+	l.dialTarget = func(ctx context.Context, target string) (net.Conn, error) {
+		close(accepted)
+		return pipeServer, nil
+	}
+
+	serveErrCh := make(chan error, 1)
+	go func() { serveErrCh <- l.Serve() }()
+
+	addr := waitForListenerAddr(t, l)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+
+	select {
+	case <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was never dialed out")
+	}
+	// Serve registered the connection in l.conns/l.wg before starting
+	// handleConn; give handleConn a moment to get into pipe before we start
+	// shutting down.
+	time.Sleep(10 * time.Millisecond)
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- l.Shutdown(context.Background()) }()
+
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the in-flight connection finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A new connection arriving while draining must be refused: Shutdown has
+	// already closed the listening socket.
+	rejected, err := net.Dial("tcp", addr)
+	if err == nil {
+		rejected.Close()
+		t.Fatal("dial during drain succeeded, want it refused because the listening socket is closed")
+	}
+
+	// Let the original in-flight connection finish.
+	conn.Close()
+	pipeClient.Close()
+
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Fatalf("Shutdown returned error: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return after the in-flight connection finished")
+	}
+
+	<-serveErrCh
+}
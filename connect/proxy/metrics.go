@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// MetricsConfig configures the optional metrics subsystem for a Proxy. It is
+// attached to Config as the Metrics field.
+type MetricsConfig struct {
+	// BindAddr is the host:port the metrics HTTP endpoint listens on, serving
+	// the registered sinks in Prometheus text exposition format. Leave empty
+	// to disable the endpoint.
+	BindAddr string `json:"bind_address,omitempty"`
+
+	// StatsdAddr, if set, streams metrics as statsd lines to this address in
+	// addition to (or instead of) serving the HTTP endpoint.
+	StatsdAddr string `json:"statsd_address,omitempty"`
+
+	// DogstatsdAddr is like StatsdAddr but uses the dogstatsd wire format,
+	// which adds support for tags.
+	DogstatsdAddr string `json:"dogstatsd_address,omitempty"`
+
+	// Prefix is prepended to all metric names. Defaults to "consul.proxy".
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (c *MetricsConfig) applyDefaults() {
+	if c.Prefix == "" {
+		c.Prefix = "consul.proxy"
+	}
+}
+
+// MetricsSink is the interface a metrics backend must implement. It's
+// intentionally small so operators can plug in an alternative sink (for
+// example to push to a different statsd-compatible collector) in place of
+// the built-in ones.
+type MetricsSink interface {
+	IncrCounter(name string, labels map[string]string, delta uint64)
+	AddSample(name string, labels map[string]string, value float64)
+	SetGauge(name string, labels map[string]string, value float64)
+}
+
+// noopSink is used when metrics are not configured so that Listener and the
+// upstream dialer paths never need to nil-check the sink.
+type noopSink struct{}
+
+func (noopSink) IncrCounter(name string, labels map[string]string, delta uint64) {}
+func (noopSink) AddSample(name string, labels map[string]string, value float64)  {}
+func (noopSink) SetGauge(name string, labels map[string]string, value float64)   {}
+
+// fanoutSink fans a single measurement out to every configured sink, so e.g.
+// the HTTP Prometheus endpoint and a statsd push can be enabled together.
+type fanoutSink []MetricsSink
+
+func (f fanoutSink) IncrCounter(name string, labels map[string]string, delta uint64) {
+	for _, s := range f {
+		s.IncrCounter(name, labels, delta)
+	}
+}
+
+func (f fanoutSink) AddSample(name string, labels map[string]string, value float64) {
+	for _, s := range f {
+		s.AddSample(name, labels, value)
+	}
+}
+
+func (f fanoutSink) SetGauge(name string, labels map[string]string, value float64) {
+	for _, s := range f {
+		s.SetGauge(name, labels, value)
+	}
+}
+
+// NewMetrics builds the MetricsSink(s) described by cfg and, if cfg.BindAddr
+// is set, starts the HTTP endpoint that exposes them. The returned stop func
+// must be called when the proxy shuts down; it is always non-nil and safe to
+// call even if no endpoint was started.
+func NewMetrics(cfg MetricsConfig, logger *log.Logger) (MetricsSink, func() error, error) {
+	cfg.applyDefaults()
+
+	var sinks fanoutSink
+	stop := func() error { return nil }
+
+	if cfg.StatsdAddr != "" {
+		s, err := newStatsdSink(cfg.Prefix, cfg.StatsdAddr, false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("metrics: failed to configure statsd sink: %s", err)
+		}
+		sinks = append(sinks, s)
+	}
+
+	if cfg.DogstatsdAddr != "" {
+		s, err := newStatsdSink(cfg.Prefix, cfg.DogstatsdAddr, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("metrics: failed to configure dogstatsd sink: %s", err)
+		}
+		sinks = append(sinks, s)
+	}
+
+	if cfg.BindAddr != "" {
+		prom := newPrometheusSink(cfg.Prefix)
+		sinks = append(sinks, prom)
+
+		ln, err := net.Listen("tcp", cfg.BindAddr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("metrics: failed to bind %s: %s", cfg.BindAddr, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", prom)
+		srv := &http.Server{Addr: cfg.BindAddr, Handler: mux}
+
+		go func() {
+			logger.Printf("[INFO] metrics endpoint listening on %s", cfg.BindAddr)
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				logger.Printf("[ERR] metrics endpoint stopped with error: %s", err)
+			}
+		}()
+		stop = srv.Close
+	}
+
+	if len(sinks) == 0 {
+		return noopSink{}, stop, nil
+	}
+	return sinks, stop, nil
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// prometheusSink is a minimal MetricsSink that renders whatever has been
+// recorded in the standard Prometheus text exposition format when scraped.
+// Histograms (AddSample) are exported as the count/sum pair of an unbucketed
+// summary, which is enough to derive averages; operators who need latency
+// buckets or quantiles should point Dogstatsd/Statsd at a fuller-featured
+// collector instead.
+type prometheusSink struct {
+	prefix string
+
+	mu       sync.Mutex
+	counters map[string]*promCounter
+	gauges   map[string]*promGauge
+	samples  map[string]*promSummary
+}
+
+type promCounter struct {
+	name   string
+	labels map[string]string
+	value  uint64
+}
+
+type promGauge struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+type promSummary struct {
+	name   string
+	labels map[string]string
+	count  uint64
+	sum    float64
+}
+
+func newPrometheusSink(prefix string) *prometheusSink {
+	return &prometheusSink{
+		prefix:   prefix,
+		counters: make(map[string]*promCounter),
+		gauges:   make(map[string]*promGauge),
+		samples:  make(map[string]*promSummary),
+	}
+}
+
+// metricKey identifies one (name, label set) series for deduplication in the
+// sink's maps. It is never rendered directly, so it doesn't need to be valid
+// exposition syntax itself, just collision-free for distinct series.
+func (s *prometheusSink) metricKey(name string, labels map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&sb, ",%q=%q", k, labels[k])
+	}
+	return sb.String()
+}
+
+func (s *prometheusSink) IncrCounter(name string, labels map[string]string, delta uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.metricKey(name, labels)
+	c, ok := s.counters[key]
+	if !ok {
+		c = &promCounter{name: name, labels: labels}
+		s.counters[key] = c
+	}
+	c.value += delta
+}
+
+func (s *prometheusSink) SetGauge(name string, labels map[string]string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.metricKey(name, labels)
+	s.gauges[key] = &promGauge{name: name, labels: labels, value: value}
+}
+
+func (s *prometheusSink) AddSample(name string, labels map[string]string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.metricKey(name, labels)
+	sm, ok := s.samples[key]
+	if !ok {
+		sm = &promSummary{name: name, labels: labels}
+		s.samples[key] = sm
+	}
+	sm.count++
+	sm.sum += value
+}
+
+// ServeHTTP renders the current metric values in Prometheus text exposition
+// format (https://prometheus.io/docs/instrumenting/exposition_formats/). It
+// implements http.Handler so it can be mounted directly on the metrics
+// endpoint's mux.
+func (s *prometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, c := range s.counters {
+		fmt.Fprintf(w, "%s%s %d\n", s.metricName(c.name), renderLabels(c.labels), c.value)
+	}
+	for _, g := range s.gauges {
+		fmt.Fprintf(w, "%s%s %g\n", s.metricName(g.name), renderLabels(g.labels), g.value)
+	}
+	for _, sm := range s.samples {
+		base := s.metricName(sm.name)
+		fmt.Fprintf(w, "%s_count%s %d\n", base, renderLabels(sm.labels), sm.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", base, renderLabels(sm.labels), sm.sum)
+	}
+}
+
+// metricName builds the exported metric name from the sink's prefix and the
+// name it was recorded under, sanitized to satisfy Prometheus's
+// [a-zA-Z_:][a-zA-Z0-9_:]* name grammar (our own names use "."-separated
+// words, e.g. "upstream.breaker.rejected", which isn't valid as-is).
+func (s *prometheusSink) metricName(name string) string {
+	return sanitizeMetricName(s.prefix + "_" + name)
+}
+
+var metricNameDisallowed = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+func sanitizeMetricName(name string) string {
+	name = metricNameDisallowed.ReplaceAllString(name, "_")
+	if name == "" {
+		return "_"
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// renderLabels formats labels as a Prometheus label-value list, e.g.
+// `{target="10.0.0.1:8080",upstream="db"}`, with values quoted and escaped
+// per the exposition format. It returns "" when there are no labels.
+func renderLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, sanitizeMetricName(k), escapeLabelValue(labels[k])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return v
+}
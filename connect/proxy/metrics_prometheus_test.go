@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeMetricName(t *testing.T) {
+	cases := map[string]string{
+		"upstream.breaker.rejected": "upstream_breaker_rejected",
+		"already_valid:name":        "already_valid:name",
+		"123starts_with_digit":      "_123starts_with_digit",
+		"":                          "_",
+	}
+	for in, want := range cases {
+		if got := sanitizeMetricName(in); got != want {
+			t.Errorf("sanitizeMetricName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+var validMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+func TestSanitizeMetricNameAlwaysProducesValidExpositionNames(t *testing.T) {
+	inputs := []string{
+		"listener.bytes_in",
+		"consul.proxy.upstream.breaker.open",
+		"..weird..",
+		"9_metric",
+		"has spaces and/slashes",
+	}
+	for _, in := range inputs {
+		got := sanitizeMetricName(in)
+		if !validMetricName.MatchString(got) {
+			t.Errorf("sanitizeMetricName(%q) = %q, not a valid Prometheus metric name", in, got)
+		}
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	cases := map[string]string{
+		`plain`:           `plain`,
+		`has "quotes"`:    `has \"quotes\"`,
+		"has\nnewline":    `has\nnewline`,
+		`back\slash`:      `back\\slash`,
+		`"\` + "\n" + `"`: `\"\\\n\"`,
+	}
+	for in, want := range cases {
+		if got := escapeLabelValue(in); got != want {
+			t.Errorf("escapeLabelValue(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRenderLabels(t *testing.T) {
+	if got := renderLabels(nil); got != "" {
+		t.Errorf("renderLabels(nil) = %q, want empty", got)
+	}
+
+	got := renderLabels(map[string]string{"upstream": "db", "target": `10.0.0.1:8080`})
+	want := `{target="10.0.0.1:8080",upstream="db"}`
+	if got != want {
+		t.Errorf("renderLabels(...) = %q, want %q", got, want)
+	}
+}
+
+func TestPrometheusSinkServeHTTPRendersValidExposition(t *testing.T) {
+	s := newPrometheusSink("consul.proxy")
+	s.IncrCounter("listener.accepted", map[string]string{"listener": `"weird" name`}, 3)
+	s.SetGauge("upstream.breaker.open", map[string]string{"upstream": "db", "target": "10.0.0.1:8080"}, 1)
+	s.AddSample("listener.connection_duration_ms", map[string]string{"listener": "public listener"}, 12.5)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain prefix", ct)
+	}
+
+	body := rec.Body.String()
+	wantLines := []string{
+		`consul_proxy_listener_accepted{listener="\"weird\" name"} 3`,
+		`consul_proxy_upstream_breaker_open{target="10.0.0.1:8080",upstream="db"} 1`,
+		`consul_proxy_listener_connection_duration_ms_count{listener="public listener"} 1`,
+		`consul_proxy_listener_connection_duration_ms_sum{listener="public listener"} 12.5`,
+	}
+	for _, want := range wantLines {
+		if !strings.Contains(body, want) {
+			t.Errorf("exposition output missing line %q\nfull output:\n%s", want, body)
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		name := line
+		if i := strings.IndexAny(line, "{ "); i >= 0 {
+			name = line[:i]
+		}
+		if !validMetricName.MatchString(name) {
+			t.Errorf("exposition line has invalid metric name %q: %q", name, line)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// statsdSink pushes metrics as UDP statsd lines. When dogstatsd is true,
+// labels are appended using the dogstatsd tag extension (`|#k:v,k:v`)
+// instead of being folded into the metric name.
+type statsdSink struct {
+	prefix    string
+	dogstatsd bool
+	conn      net.Conn
+}
+
+func newStatsdSink(prefix, addr string, dogstatsd bool) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{prefix: prefix, dogstatsd: dogstatsd, conn: conn}, nil
+}
+
+func (s *statsdSink) IncrCounter(name string, labels map[string]string, delta uint64) {
+	s.send(name, labels, fmt.Sprintf("%d|c", delta))
+}
+
+func (s *statsdSink) SetGauge(name string, labels map[string]string, value float64) {
+	s.send(name, labels, fmt.Sprintf("%g|g", value))
+}
+
+func (s *statsdSink) AddSample(name string, labels map[string]string, value float64) {
+	s.send(name, labels, fmt.Sprintf("%g|ms", value))
+}
+
+func (s *statsdSink) send(name string, labels map[string]string, valueAndType string) {
+	var sb strings.Builder
+	sb.WriteString(s.prefix)
+	sb.WriteByte('.')
+	sb.WriteString(name)
+
+	if !s.dogstatsd {
+		// Plain statsd has no tag support, so fold labels into the name to
+		// keep series distinguishable.
+		for _, k := range sortedKeys(labels) {
+			fmt.Fprintf(&sb, ".%s.%s", k, labels[k])
+		}
+	}
+
+	sb.WriteByte(':')
+	sb.WriteString(valueAndType)
+
+	if s.dogstatsd && len(labels) > 0 {
+		sb.WriteString("|#")
+		for i, k := range sortedKeys(labels) {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, "%s:%s", k, labels[k])
+		}
+	}
+
+	// Best effort: a dropped metrics datagram should never affect proxying.
+	_, _ = s.conn.Write([]byte(sb.String()))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
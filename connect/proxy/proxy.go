@@ -2,8 +2,12 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
 	"log"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/connect"
@@ -17,6 +21,45 @@ type Proxy struct {
 	stopChan   chan struct{}
 	logger     *log.Logger
 	service    *connect.Service
+
+	// closeOnce guards stopChan: Close and Shutdown are both allowed to be
+	// the one that tears the proxy down, but only one of them may close the
+	// channel.
+	closeOnce sync.Once
+
+	// mu guards every field below that the Serve loop's reconcile methods
+	// mutate, since Close/Shutdown can run concurrently with Serve from
+	// another goroutine.
+	mu sync.Mutex
+
+	publicListenerCfg PublicListenerConfig
+	publicListener    *Listener
+
+	// upstreams tracks the currently running upstream listeners keyed by
+	// UpstreamConfig.String() so that config changes can be reconciled by
+	// diffing against the previous set instead of blindly restarting
+	// everything on every config event.
+	upstreams map[string]*upstreamState
+
+	// metrics is the sink that Listener.Serve and the upstream dialer paths
+	// report connection counts, byte counts and durations to. It defaults to
+	// a no-op sink until the first config event configures it.
+	metrics     MetricsSink
+	metricsStop func() error
+
+	// drainTimeout bounds how long Shutdown will wait for in-flight
+	// connections to finish on their own before giving up on them. It is
+	// kept in sync with the most recently seen Config.DrainTimeoutMs.
+	drainTimeout time.Duration
+}
+
+// upstreamState pairs a running upstream Listener with the config it was
+// started with, so a later config event can tell whether anything that
+// matters actually changed.
+type upstreamState struct {
+	cfg     UpstreamConfig
+	l       *Listener
+	breaker *circuitBreaker
 }
 
 // NewFromConfigFile returns a Proxy instance configured just from a local file.
@@ -43,6 +86,8 @@ func NewFromConfigFile(client *api.Client, filename string,
 		stopChan:   make(chan struct{}),
 		logger:     logger,
 		service:    service,
+		upstreams:  make(map[string]*upstreamState),
+		metrics:    noopSink{},
 	}
 	return p, nil
 }
@@ -60,6 +105,8 @@ func New(client *api.Client, proxyID string, logger *log.Logger) (*Proxy, error)
 		cfgWatcher: cw,
 		stopChan:   make(chan struct{}),
 		logger:     logger,
+		upstreams:  make(map[string]*upstreamState),
+		metrics:    noopSink{},
 		// Can't load service yet as we only have the proxy's ID not the service's
 		// until initial config fetch happens.
 	}
@@ -96,34 +143,26 @@ func (p *Proxy) Serve() error {
 					p.logger.Printf("[DEBUG] leaf: %s roots: %s", leaf.URIs[0], bytes.Join(tcfg.RootCAs.Subjects(), []byte(",")))
 				}()
 
-				newCfg.PublicListener.applyDefaults()
-				l := NewPublicListener(p.service, newCfg.PublicListener, p.logger)
-				err = p.startListener("public listener", l)
+				sink, stop, err := NewMetrics(newCfg.Metrics, p.logger)
 				if err != nil {
 					return err
 				}
+				p.mu.Lock()
+				p.metrics = sink
+				p.metricsStop = stop
+				p.mu.Unlock()
 			}
 
-			// TODO(banks) update/remove upstreams properly based on a diff with current. Can
-			// store a map of uc.String() to Listener here and then use it to only
-			// start one of each and stop/modify if changes occur.
-			for _, uc := range newCfg.Upstreams {
-				uc.applyDefaults()
-				uc.resolver = UpstreamResolverFromClient(p.client, uc)
-
-				if uc.LocalBindPort < 1 {
-					p.logger.Printf("[ERR] upstream %s has no local_bind_port. "+
-						"Can't start upstream.", uc.String())
-					continue
-				}
-
-				l := NewUpstreamListener(p.service, uc, p.logger)
-				err := p.startListener(uc.String(), l)
-				if err != nil {
-					p.logger.Printf("[ERR] failed to start upstream %s: %s", uc.String(),
-						err)
-				}
+			if err := p.reconcilePublicListener(newCfg.PublicListener); err != nil {
+				return err
 			}
+
+			p.reconcileUpstreams(newCfg.Upstreams)
+
+			p.mu.Lock()
+			p.drainTimeout = time.Duration(newCfg.DrainTimeoutMs) * time.Millisecond
+			p.mu.Unlock()
+
 			cfg = newCfg
 
 		case <-p.stopChan:
@@ -132,6 +171,101 @@ func (p *Proxy) Serve() error {
 	}
 }
 
+// reconcilePublicListener starts the public listener on first config, and
+// restarts it only if something in its config (bind address, TLS options
+// etc) actually changed since the currently running instance was started.
+func (p *Proxy) reconcilePublicListener(newCfg PublicListenerConfig) error {
+	newCfg.applyDefaults()
+
+	p.mu.Lock()
+	old := p.publicListener
+	unchanged := old != nil && reflect.DeepEqual(p.publicListenerCfg, newCfg)
+	p.mu.Unlock()
+
+	if unchanged {
+		// Nothing changed, leave the running listener alone.
+		return nil
+	}
+
+	if old != nil {
+		p.logger.Printf("[INFO] public listener config changed, restarting")
+		old.Close()
+	}
+
+	l := NewPublicListener(p.service, newCfg, p.metricsSink(), p.logger)
+	if err := p.startListener("public listener", l); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.publicListener = l
+	p.publicListenerCfg = newCfg
+	p.mu.Unlock()
+	return nil
+}
+
+// metricsSink returns the currently configured metrics sink.
+func (p *Proxy) metricsSink() MetricsSink {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.metrics
+}
+
+// reconcileUpstreams diffs newUpstreams against the set of currently running
+// upstream listeners, starting any that are new, restarting any whose bind
+// address, resolver or timeouts changed, and closing any that were removed
+// from the config entirely.
+func (p *Proxy) reconcileUpstreams(newUpstreams []UpstreamConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	seen := make(map[string]struct{}, len(newUpstreams))
+
+	for _, uc := range newUpstreams {
+		uc.applyDefaults()
+		uc.resolver = UpstreamResolverFromClient(p.client, uc)
+
+		if uc.LocalBindPort < 1 {
+			p.logger.Printf("[ERR] upstream %s has no local_bind_port. "+
+				"Can't start upstream.", uc.String())
+			continue
+		}
+
+		key := uc.String()
+		seen[key] = struct{}{}
+
+		if existing, ok := p.upstreams[key]; ok {
+			if reflect.DeepEqual(existing.cfg, uc) {
+				// Unchanged, leave the running listener alone.
+				continue
+			}
+			p.logger.Printf("[INFO] upstream %s config changed, restarting", key)
+			existing.l.Close()
+			delete(p.upstreams, key)
+		}
+
+		breaker := newCircuitBreaker(uc.CircuitBreaker, key, p.metrics)
+
+		l := NewUpstreamListener(p.service, uc, breaker, p.metrics, p.logger)
+		if err := p.startListener(key, l); err != nil {
+			p.logger.Printf("[ERR] failed to start upstream %s: %s", key, err)
+			p.metrics.IncrCounter("upstream.start_error", map[string]string{"upstream": key}, 1)
+			continue
+		}
+		p.upstreams[key] = &upstreamState{cfg: uc, l: l, breaker: breaker}
+	}
+
+	// Anything left running that wasn't in the new config has been removed.
+	for key, state := range p.upstreams {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		p.logger.Printf("[INFO] upstream %s removed, stopping", key)
+		state.l.Close()
+		delete(p.upstreams, key)
+	}
+}
+
 // startPublicListener is run from the internal state machine loop
 func (p *Proxy) startListener(name string, l *Listener) error {
 	p.logger.Printf("[INFO] %s starting on %s", name, l.BindAddr())
@@ -153,11 +287,84 @@ func (p *Proxy) startListener(name string, l *Listener) error {
 	return nil
 }
 
-// Close stops the proxy and terminates all active connections. It must be
-// called only once.
+// Close stops the proxy and terminates all active connections. It is safe
+// to call more than once, and safe to call concurrently with Shutdown:
+// whichever one runs first closes stopChan, the other is a no-op on that
+// front.
 func (p *Proxy) Close() {
-	close(p.stopChan)
+	p.closeOnce.Do(func() { close(p.stopChan) })
+	if p.service != nil {
+		p.service.Close()
+	}
+	if stop := p.metricsStopFunc(); stop != nil {
+		if err := stop(); err != nil {
+			p.logger.Printf("[ERR] error stopping metrics endpoint: %s", err)
+		}
+	}
+}
+
+// Shutdown stops all listeners from accepting new connections but, unlike
+// Close, lets connections already being served finish before returning. It
+// waits until every listener has drained, ctx is done, or the configured
+// drain timeout elapses, whichever happens first. It is safe to call more
+// than once or concurrently with Close, and causes Serve to return cleanly
+// once draining completes.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	drainTimeout := p.drainTimeout
+	listeners := make([]*Listener, 0, len(p.upstreams)+1)
+	if p.publicListener != nil {
+		listeners = append(listeners, p.publicListener)
+	}
+	for _, state := range p.upstreams {
+		listeners = append(listeners, state.l)
+	}
+	p.mu.Unlock()
+
+	if drainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, drainTimeout)
+		defer cancel()
+	}
+
+	errCh := make(chan error, len(listeners))
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *Listener) {
+			defer wg.Done()
+			if err := l.Shutdown(ctx); err != nil {
+				errCh <- err
+			}
+		}(l)
+	}
+	wg.Wait()
+	close(errCh)
+
+	// All listeners have either drained or hit the deadline; unblock Serve
+	// and tear down the rest of the proxy the same way Close does.
+	p.closeOnce.Do(func() { close(p.stopChan) })
 	if p.service != nil {
 		p.service.Close()
 	}
+	if stop := p.metricsStopFunc(); stop != nil {
+		if err := stop(); err != nil {
+			p.logger.Printf("[ERR] error stopping metrics endpoint: %s", err)
+		}
+	}
+
+	for err := range errCh {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricsStopFunc returns the func that stops the metrics endpoint, if one
+// was ever configured.
+func (p *Proxy) metricsStopFunc() func() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.metricsStop
 }
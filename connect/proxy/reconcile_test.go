@@ -0,0 +1,18 @@
+package proxy
+
+import "testing"
+
+// TestReconcileUpstreamsAddRemoveModify is a placeholder for coverage of
+// reconcileUpstreams/reconcilePublicListener's add/remove/modify diffing.
+// It can't be written against this checkout: UpstreamConfig,
+// PublicListenerConfig, Config and UpstreamResolverFromClient, all of which
+// reconcileUpstreams and reconcilePublicListener depend on directly, aren't
+// defined anywhere in this tree (see proxy.go's imports and NewFromConfigFile).
+// Once those live alongside this package again, this test should construct a
+// Proxy, feed reconcileUpstreams successive []UpstreamConfig slices, and
+// assert p.upstreams gains an entry for an added upstream, keeps the same
+// *Listener for an unchanged one, restarts it for a modified one, and drops
+// it for a removed one.
+func TestReconcileUpstreamsAddRemoveModify(t *testing.T) {
+	t.Skip("requires UpstreamConfig/Config/UpstreamResolverFromClient, not present in this checkout")
+}